@@ -0,0 +1,196 @@
+package sshpool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DynamicTunnel is a SOCKS5 proxy (the ssh -D equivalent): it listens on
+// local and, for each incoming SOCKS5 CONNECT request, dials the requested
+// address via host. Be sure to call Close() to clean up.
+type DynamicTunnel struct {
+	listener net.Listener
+	pool     *Pool
+	host     string
+	ctx      context.Context
+}
+
+// DynamicTunnel() starts a SOCKS5 proxy on local that tunnels connections
+// through host.
+func (p *Pool) DynamicTunnel(host, local string) (*DynamicTunnel, error) {
+	return p.DynamicTunnelContext(context.Background(), host, local)
+}
+
+// DynamicTunnelContext is like DynamicTunnel, but ctx can cancel the wait for
+// a session on host for each proxied connection.
+func (p *Pool) DynamicTunnelContext(ctx context.Context, host, local string) (*DynamicTunnel, error) {
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+
+	dt := &DynamicTunnel{
+		listener: listener,
+		pool:     p,
+		host:     host,
+		ctx:      ctx,
+	}
+
+	go dt.accept()
+
+	return dt, nil
+}
+
+func (dt *DynamicTunnel) Close() error {
+	return dt.listener.Close()
+}
+
+func (dt *DynamicTunnel) Addr() string {
+	return dt.listener.Addr().String()
+}
+
+func (dt *DynamicTunnel) accept() {
+	for {
+		conn, err := dt.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				// probably a graceful shutdown
+				return
+			}
+			log.Println("socks5 listener accept:", err)
+			return
+		}
+
+		go dt.serve(conn)
+	}
+}
+
+// socks5 reply codes, per RFC 1928 section 6.
+const (
+	socks5Succeeded         = 0x00
+	socks5GeneralFailure    = 0x01
+	socks5ConnectionRefused = 0x05
+)
+
+func (dt *DynamicTunnel) serve(local net.Conn) {
+	defer local.Close()
+
+	target, err := socks5Handshake(local)
+	if err != nil {
+		log.Println("socks5 handshake:", err)
+		return
+	}
+
+	c, _, err := dt.pool.get_client(dt.ctx, dt.host)
+	if err != nil {
+		socks5Reply(local, socks5GeneralFailure)
+		return
+	}
+	defer c.release()
+
+	remote, err := c.Dial("tcp", target)
+	if err != nil {
+		socks5Reply(local, socks5ConnectionRefused)
+		return
+	}
+	defer remote.Close()
+
+	if err := socks5Reply(local, socks5Succeeded); err != nil {
+		return
+	}
+
+	go func() {
+		defer remote.Close()
+		if _, err := io.Copy(remote, local); err != nil {
+			log.Println("copy local, remote:", err)
+		}
+	}()
+
+	if _, err := io.Copy(local, remote); err != nil {
+		log.Println("copy remote, local:", err)
+	}
+}
+
+// socks5Handshake performs the (unauthenticated) SOCKS5 method negotiation
+// and reads the CONNECT request, returning the requested "host:port". Only
+// the CONNECT command is supported; anything else is an error.
+func socks5Handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("read greeting: %w", err)
+	}
+	if header[0] != 0x05 {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("read methods: %w", err)
+	}
+
+	// no authentication required
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", fmt.Errorf("write method selection: %w", err)
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", fmt.Errorf("read request: %w", err)
+	}
+	if req[0] != 0x05 {
+		return "", fmt.Errorf("unsupported socks version %d", req[0])
+	}
+	if req[1] != 0x01 {
+		socks5Reply(conn, 0x07) // command not supported
+		return "", fmt.Errorf("unsupported socks command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case 0x01: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("read ipv4 address: %w", err)
+		}
+		host = net.IP(addr).String()
+	case 0x03: // domain name
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", fmt.Errorf("read domain length: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", fmt.Errorf("read domain: %w", err)
+		}
+		host = string(domain)
+	case 0x04: // IPv6
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", fmt.Errorf("read ipv6 address: %w", err)
+		}
+		host = net.IP(addr).String()
+	default:
+		socks5Reply(conn, 0x08) // address type not supported
+		return "", fmt.Errorf("unsupported socks address type %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", fmt.Errorf("read port: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socks5Reply writes a minimal SOCKS5 reply with the given status code. The
+// bound address is always reported as 0.0.0.0:0, which is fine for clients
+// that (like everyone in practice) ignore it for CONNECT.
+func socks5Reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -1,6 +1,7 @@
-package pool
+package sshpool
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -12,7 +13,14 @@ const (
 )
 
 func (p *Pool) ExecCombinedOutput(host string, command string) ([]byte, error) {
-	session, err := p.Get(host)
+	return p.ExecCombinedOutputContext(context.Background(), host, command)
+}
+
+// ExecCombinedOutputContext is like ExecCombinedOutput, but ctx can cancel
+// the wait for a session (including the dial, if a new connection is
+// needed) before the command runs.
+func (p *Pool) ExecCombinedOutputContext(ctx context.Context, host string, command string) ([]byte, error) {
+	session, err := p.GetContext(ctx, host)
 	if err != nil {
 		return nil, fmt.Errorf("Error executing on host %s command %#v: %v", host, command, err)
 	}
@@ -29,7 +37,14 @@ func (p *Pool) ExecCombinedOutput(host string, command string) ([]byte, error) {
 }
 
 func (p *Pool) ExecOutput(host string, command string) ([]byte, error) {
-	session, err := p.Get(host)
+	return p.ExecOutputContext(context.Background(), host, command)
+}
+
+// ExecOutputContext is like ExecOutput, but ctx can cancel the wait for a
+// session (including the dial, if a new connection is needed) before the
+// command runs.
+func (p *Pool) ExecOutputContext(ctx context.Context, host string, command string) ([]byte, error) {
+	session, err := p.GetContext(ctx, host)
 	if err != nil {
 		return nil, fmt.Errorf("Error executing on host %s command %#v: %v", host, command, err)
 	}
@@ -0,0 +1,194 @@
+package sshpool
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// markReserved records that a caller (as opposed to the keepalive subsystem)
+// now holds a session slot on c. It must be called exactly once per
+// successful reservation made outside of startKeepalive, after the send on
+// c.sessions has succeeded.
+func (c *client) markReserved() {
+	atomic.AddInt32(&c.inuse, 1)
+}
+
+// release gives back a session slot reserved via get_client, and records
+// when it happened so the idle reaper can tell how long a connection has
+// been unused. Session.Put and SFTPSession.Put call this after their usual
+// drain delay; anything else that reserves a slot directly (tunnels) calls
+// it as soon as it's done with the slot.
+func (c *client) release() {
+	<-c.sessions
+	atomic.AddInt32(&c.inuse, -1)
+
+	c.lastReleasedMu.Lock()
+	c.lastReleased = time.Now()
+	c.lastReleasedMu.Unlock()
+}
+
+func (c *client) idleFor() time.Duration {
+	c.lastReleasedMu.Lock()
+	lr := c.lastReleased
+	c.lastReleasedMu.Unlock()
+	return time.Since(lr)
+}
+
+// reapLoop periodically closes and evicts connections that have sat idle
+// (no caller-held sessions) for longer than MaxIdleTime.
+func (p *Pool) reapLoop() {
+	interval := p.poolconfig.MaxIdleTime / 4
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.reaperStop:
+			return
+		case <-ticker.C:
+			p.reapIdle()
+		}
+	}
+}
+
+func (p *Pool) reapIdle() {
+	maxIdle := p.poolconfig.MaxIdleTime
+	if maxIdle <= 0 {
+		return
+	}
+
+	type candidate struct {
+		host string
+		c    *client
+	}
+	var candidates []candidate
+
+	p.clients_mu.Lock()
+	for host, list := range p.clients {
+		for _, c := range list {
+			if atomic.LoadInt32(&c.closed) == 1 {
+				continue
+			}
+			if atomic.LoadInt32(&c.inuse) != 0 {
+				continue
+			}
+			if c.idleFor() < maxIdle {
+				continue
+			}
+			candidates = append(candidates, candidate{host, c})
+		}
+	}
+	p.clients_mu.Unlock()
+
+	for _, cand := range candidates {
+		p.reapClient(cand.host, cand.c)
+	}
+}
+
+// reapClient tries to claim every caller-available slot in c.sessions before
+// closing it, so a get_client call that just selected c (and is blocked
+// sending, or about to send) never ends up handed a closed connection. If
+// any slot is taken, something is using c right now and we back off.
+func (p *Pool) reapClient(host string, c *client) {
+	slots := cap(c.sessions)
+	if c.keepaliveReserved {
+		// keepalive holds one slot for the life of the connection; it's not
+		// up for grabs here and shouldn't count against idleness.
+		slots--
+	}
+	if slots <= 0 {
+		return
+	}
+
+	claimed := 0
+	for claimed < slots {
+		select {
+		case c.sessions <- struct{}{}:
+			claimed++
+		default:
+			for ; claimed > 0; claimed-- {
+				<-c.sessions
+			}
+			return
+		}
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		for ; claimed > 0; claimed-- {
+			<-c.sessions
+		}
+		return
+	}
+
+	p.clients_mu.Lock()
+	list := p.clients[host]
+	for i, cc := range list {
+		if cc == c {
+			p.clients[host] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	p.clients_mu.Unlock()
+
+	if p.poolconfig.Debug {
+		fmt.Printf("sshpool %s c%d idle timeout, evicting\n", host, c.clientid)
+	}
+
+	close(c.stop)
+	close(c.evicted)
+	c.Client.Close()
+}
+
+// HostStats reports the pool's current state for a single host.
+type HostStats struct {
+	Connections   int           // number of currently pooled connections
+	InUseSessions int           // sum of caller-held sessions across those connections
+	IdleTime      time.Duration // time since the most recently released connection last released a session; zero if any connection is in use
+	DialErrors    int           // cumulative dial failures recorded for this host
+}
+
+// Stats reports per-host connection counts, in-use sessions, idle time, and
+// dial errors.
+func (p *Pool) Stats() map[string]HostStats {
+	stats := make(map[string]HostStats)
+
+	p.clients_mu.Lock()
+	for host, list := range p.clients {
+		hs := HostStats{Connections: len(list)}
+
+		var minIdle time.Duration
+		anyInUse := false
+		for i, c := range list {
+			inuse := int(atomic.LoadInt32(&c.inuse))
+			hs.InUseSessions += inuse
+			if inuse > 0 {
+				anyInUse = true
+			}
+			idle := c.idleFor()
+			if i == 0 || idle < minIdle {
+				minIdle = idle
+			}
+		}
+		if !anyInUse {
+			hs.IdleTime = minIdle
+		}
+
+		stats[host] = hs
+	}
+	p.clients_mu.Unlock()
+
+	p.dialErrors_mu.Lock()
+	for host, n := range p.dialErrors {
+		hs := stats[host]
+		hs.DialErrors = n
+		stats[host] = hs
+	}
+	p.dialErrors_mu.Unlock()
+
+	return stats
+}
@@ -0,0 +1,94 @@
+package sshpool
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// TestReapClientEvictsIdleClient checks the happy path: a client with every
+// slot free (no in-flight sessions) gets claimed, closed, and dropped from
+// the pool.
+func TestReapClientEvictsIdleClient(t *testing.T) {
+	p := New(nil, &PoolConfig{})
+
+	c := newTestClient(1, 2)
+	p.clients["host"] = []*client{c}
+
+	p.reapClient("host", c)
+
+	if atomic.LoadInt32(&c.closed) != 1 {
+		t.Errorf("closed: want 1, got 0")
+	}
+	if len(p.clients["host"]) != 0 {
+		t.Errorf("client not removed from pool: %v", p.clients["host"])
+	}
+	select {
+	case <-c.evicted:
+	default:
+		t.Errorf("evicted channel was not closed")
+	}
+}
+
+// TestReapClientBacksOffWhenInUse checks that reapClient never claims a
+// connection's slots (and never closes it) if a caller already holds one:
+// get_client may have just selected this client and be about to use it.
+func TestReapClientBacksOffWhenInUse(t *testing.T) {
+	p := New(nil, &PoolConfig{})
+
+	c := newTestClient(1, 2)
+	c.sessions <- struct{}{} // simulate a caller-held session
+
+	p.clients["host"] = []*client{c}
+
+	p.reapClient("host", c)
+
+	if atomic.LoadInt32(&c.closed) != 0 {
+		t.Errorf("closed: want 0 (client in use), got 1")
+	}
+	if len(p.clients["host"]) != 1 {
+		t.Errorf("client removed from pool while in use: %v", p.clients["host"])
+	}
+	if len(c.sessions) != 1 {
+		t.Errorf("sessions: want the one caller-held slot preserved, got %d held", len(c.sessions))
+	}
+}
+
+// TestReapClientLosesCASRace checks the reaper/keepalive interplay: if
+// something else (keepalive) already evicted the client between reapIdle's
+// snapshot and reapClient's CAS, reapClient must back off cleanly instead of
+// double-closing or leaking the slots it provisionally claimed.
+func TestReapClientLosesCASRace(t *testing.T) {
+	p := New(nil, &PoolConfig{})
+
+	c := newTestClient(1, 2)
+	atomic.StoreInt32(&c.closed, 1) // as if keepalive's evict() already ran
+	p.clients["host"] = []*client{c}
+
+	p.reapClient("host", c)
+
+	if len(p.clients["host"]) != 1 {
+		t.Errorf("reapClient should not touch p.clients when the CAS loses: %v", p.clients["host"])
+	}
+	if len(c.sessions) != 0 {
+		t.Errorf("sessions: want provisional claims given back, got %d held", len(c.sessions))
+	}
+}
+
+// TestReapClientReservesKeepaliveSlot checks that the dedicated keepalive
+// slot is never up for grabs: with keepaliveReserved set, a client with only
+// that slot occupied (no caller sessions) still counts as fully idle.
+func TestReapClientReservesKeepaliveSlot(t *testing.T) {
+	p := New(nil, &PoolConfig{})
+
+	c := newTestClient(1, 2)
+	c.keepaliveReserved = true
+	c.sessions <- struct{}{} // keepalive's own dedicated slot
+
+	p.clients["host"] = []*client{c}
+
+	p.reapClient("host", c)
+
+	if atomic.LoadInt32(&c.closed) != 1 {
+		t.Errorf("closed: want 1 (idle apart from keepalive's slot), got 0")
+	}
+}
@@ -0,0 +1,88 @@
+package sshpool
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnectionDead describes a connection that was evicted by the keepalive
+// subsystem. No function in this package returns it: the underlying
+// *ssh.Client is closed immediately, so any Session or SFTPSession still in
+// use fails its own I/O with an error from the ssh/sftp packages, not with
+// ErrConnectionDead.
+var ErrConnectionDead = errors.New("sshpool: connection is dead (keepalive failed)")
+
+// startKeepalive launches the background health check goroutine for c, if
+// KeepaliveInterval/KeepaliveTimeout are configured. It holds the dedicated
+// slot in c.sessions that get_client's dial path claimed for it, for the
+// lifetime of the connection, so it never races with Put() decrementing that
+// channel; the goroutine gives the slot back when it exits.
+func (p *Pool) startKeepalive(host string, c *client) {
+	interval := p.poolconfig.KeepaliveInterval
+	timeout := p.poolconfig.KeepaliveTimeout
+	if interval == 0 || timeout == 0 {
+		return
+	}
+
+	go func() {
+		defer func() { <-c.sessions }()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := c.Client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case err := <-reply:
+				if err != nil {
+					p.evict(host, c)
+					return
+				}
+			case <-time.After(timeout):
+				p.evict(host, c)
+				return
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// evict marks c dead, removes it from p.clients[host], wakes up anything
+// blocked trying to reserve a session on it, and closes the underlying
+// connection.
+func (p *Pool) evict(host string, c *client) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+
+	if p.poolconfig.Debug {
+		fmt.Printf("sshpool %s c%d keepalive failed, evicting\n", host, c.clientid)
+	}
+
+	p.clients_mu.Lock()
+	list := p.clients[host]
+	for i, cc := range list {
+		if cc == c {
+			p.clients[host] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	p.clients_mu.Unlock()
+
+	close(c.evicted)
+	c.Client.Close()
+}
@@ -1,10 +1,12 @@
 package sshpool
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -34,12 +36,31 @@ type Pool struct {
 
 	dialing_mu sync.Mutex
 	dialing    map[string]chan struct{}
+
+	unhealthy_mu sync.Mutex
+	unhealthy    map[string]time.Time // host -> unhealthy until this time
+
+	dialErrors_mu sync.Mutex
+	dialErrors    map[string]int // host -> cumulative dial failure count
+
+	reaperStop    chan struct{}
+	reaperRunning bool
 }
 
 type client struct {
 	*ssh.Client
 	sessions chan struct{} // this channel is used for MaxSessions limiting
 	clientid int
+
+	evicted           chan struct{} // closed once this client is evicted, by the keepalive goroutine or the idle reaper
+	stop              chan struct{} // closed by Pool.Close or the idle reaper to stop this client's keepalive goroutine
+	closed            int32         // atomic; 1 once this client has been evicted/closed
+	keepaliveReserved bool          // true if sessions has a dedicated capacity slot held by keepalive
+
+	inuse int32 // atomic count of caller-held sessions (excludes keepalive's dedicated slot)
+
+	lastReleasedMu sync.Mutex
+	lastReleased   time.Time // last time a caller released a session, used for idle eviction
 }
 
 type PoolConfig struct {
@@ -60,6 +81,32 @@ type PoolConfig struct {
 	// by giving a very slight delay after closing but before allowing another
 	// connection. If 0, DefaultSessionCloseDelay is used.
 	SessionCloseDelay time.Duration
+
+	// KeepaliveInterval sets how often an out-of-band keepalive@openssh.com
+	// request is sent on each pooled connection to check that it's still
+	// alive. If left at 0, keepalive checking is disabled.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout sets how long to wait for a keepalive reply before the
+	// connection is considered dead. A dead connection is closed and evicted
+	// from the pool, waking up anything blocked waiting for a free session on
+	// it. If left at 0, keepalive checking is disabled.
+	KeepaliveTimeout time.Duration
+
+	// DialRetry configures retrying on transient failures to dial a host or
+	// to open a session/sftp client on an existing connection. If left nil,
+	// no retrying happens, matching the pre-retry behavior.
+	DialRetry *DialRetryConfig
+
+	// MaxIdleTime closes and evicts a pooled connection once it has had no
+	// in-flight sessions for this long. If left at 0, idle connections are
+	// never reaped.
+	MaxIdleTime time.Duration
+
+	// SFTPTransfer configures the PutFile/GetFile/PutDir/GetDir helpers and
+	// the sftp client's own packet size and pipelining. If left nil, the
+	// package defaults are used.
+	SFTPTransfer *SFTPTransferConfig
 }
 
 type Session struct {
@@ -94,7 +141,7 @@ func (s *Session) Put() {
 		} else {
 			time.Sleep(s.pool.poolconfig.SessionCloseDelay)
 		}
-		_ = <-s.client.sessions
+		s.client.release()
 	}()
 
 	return
@@ -104,12 +151,21 @@ func New(config *ssh.ClientConfig, poolconfig *PoolConfig) *Pool {
 	if poolconfig == nil {
 		poolconfig = &PoolConfig{}
 	}
-	return &Pool{
+	p := &Pool{
 		config:     config,
 		poolconfig: poolconfig,
 		clients:    make(map[string][]*client),
 		dialing:    make(map[string]chan struct{}),
+		dialErrors: make(map[string]int),
 	}
+
+	if poolconfig.MaxIdleTime > 0 {
+		p.reaperStop = make(chan struct{})
+		p.reaperRunning = true
+		go p.reapLoop()
+	}
+
+	return p
 }
 
 // Get() creates a session to a specific host. If successful, err will be nil
@@ -117,10 +173,17 @@ func New(config *ssh.ClientConfig, poolconfig *PoolConfig) *Pool {
 // the host connection already has MaxSessions sessions and MaxConnections is met,
 // Get() will block until another connection somewhere calls Put().
 func (p *Pool) Get(host string) (*Session, error) {
-	// NOTE see also GetSFTP()
+	return p.GetContext(context.Background(), host)
+}
+
+// GetContext is like Get, but the wait for a free session slot (or for a new
+// connection to dial) is cancellable via ctx. If ctx is done first, the
+// returned error wraps ctx.Err().
+func (p *Pool) GetContext(ctx context.Context, host string) (*Session, error) {
+	// NOTE see also GetSFTPContext()
 
 	// get_client will already have done a send on client.sessions for us.
-	client, sessionid, err := p.get_client(host)
+	client, sessionid, err := p.get_client(ctx, host)
 	if err != nil {
 		return nil, err
 	}
@@ -129,9 +192,9 @@ func (p *Pool) Get(host string) (*Session, error) {
 		//fmt.Printf("sshpool %s c%d s%d new session\n", host, client.clientid, sessionid)
 	}
 
-	s, err := client.Client.NewSession()
+	s, err := p.newSessionWithRetry(ctx, client.Client)
 	if err != nil {
-		_ = <-client.sessions
+		client.release()
 		return nil, err
 	}
 
@@ -147,7 +210,7 @@ func (p *Pool) Get(host string) (*Session, error) {
 }
 
 // Take care here, there are tricky nested mutex locks.
-func (p *Pool) get_client(host string) (*client, int, error) {
+func (p *Pool) get_client(ctx context.Context, host string) (*client, int, error) {
 
 	var maxc = p.poolconfig.MaxConnections
 	if maxc == 0 {
@@ -161,13 +224,29 @@ func (p *Pool) get_client(host string) (*client, int, error) {
 
 retry:
 
+	select {
+	case <-ctx.Done():
+		return nil, 0, fmt.Errorf("sshpool: %s: %w", host, ctx.Err())
+	default:
+	}
+
+	// if host is cooling down after repeated dial failures, fail fast
+	// instead of piling more callers up behind dialchan.
+	if err := p.checkUnhealthy(host); err != nil {
+		return nil, 0, err
+	}
+
 	// if another Get() to the same host is blocked on dial, we want to block
 	p.dialing_mu.Lock()
 	dialchan = p.dialing[host]
 	p.dialing_mu.Unlock()
 
 	if dialchan != nil {
-		_, _ = <-dialchan
+		select {
+		case <-dialchan:
+		case <-ctx.Done():
+			return nil, 0, fmt.Errorf("sshpool: %s: %w", host, ctx.Err())
+		}
 	}
 
 	var (
@@ -182,16 +261,23 @@ retry:
 		p.nextsessionid++
 		sessionid = p.nextsessionid
 	}
+clientLoop:
 	for _, client := range p.clients[host] {
+		if atomic.LoadInt32(&client.closed) == 1 {
+			continue
+		}
 		select {
 		case client.sessions <- struct{}{}:
 			noblock = client
-			break
+			break clientLoop
 		default:
 		}
 	}
 	if noblock == nil && len(p.clients[host]) == maxc {
 		for _, c := range p.clients[host] {
+			if atomic.LoadInt32(&c.closed) == 1 {
+				continue
+			}
 			block = append(block, c)
 		}
 	}
@@ -199,6 +285,7 @@ retry:
 
 	if noblock != nil {
 		// best case: we found a client and it had a free spot and we have already reserved it.
+		noblock.markReserved()
 		return noblock, sessionid, nil
 	}
 
@@ -208,17 +295,41 @@ retry:
 
 		// fast case: we only have one candidate
 		if len(block) == 1 {
-			block[0].sessions <- struct{}{}
-			return block[0], sessionid, nil
+			select {
+			case block[0].sessions <- struct{}{}:
+				block[0].markReserved()
+				return block[0], sessionid, nil
+			case <-block[0].evicted:
+				// keepalive determined this client is dead while we waited; retry.
+				goto retry
+			case <-ctx.Done():
+				return nil, 0, fmt.Errorf("sshpool: %s: %w", host, ctx.Err())
+			}
 		}
 
-		// slow case: use the reflect package for a dynamic select
-		cases := make([]reflect.SelectCase, len(block))
-		for i, b := range block {
-			cases[i] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(b.sessions), Send: reflect.ValueOf(struct{}{})}
+		// slow case: use the reflect package for a dynamic select. Each candidate
+		// contributes both a send case (a session slot freed up) and a receive
+		// case on its evicted channel (keepalive found it dead) so a client dying
+		// while we're blocked here doesn't wedge us forever. A final case lets
+		// ctx cancellation unblock us too.
+		cases := make([]reflect.SelectCase, 0, len(block)*2+1)
+		for _, b := range block {
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(b.sessions), Send: reflect.ValueOf(struct{}{})},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(b.evicted)},
+			)
 		}
+		ctxdoneidx := len(cases)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
 		chosen, _, _ := reflect.Select(cases)
-		return block[chosen], sessionid, nil
+		if chosen == ctxdoneidx {
+			return nil, 0, fmt.Errorf("sshpool: %s: %w", host, ctx.Err())
+		}
+		if chosen%2 == 1 {
+			goto retry
+		}
+		block[chosen/2].markReserved()
+		return block[chosen/2], sessionid, nil
 	}
 
 	// now we dial, unless another call to Get() beat us in the race.
@@ -268,9 +379,12 @@ retry:
 		config = &newconfig
 	}
 
-	sshclient, err := ssh.Dial("tcp", addr, config)
+	sshclient, err := p.dialWithRetry(ctx, host, addr, config)
 	if err != nil {
-		return nil, 0, fmt.Errorf("ssh dial %#v: %v", host, err)
+		p.dialErrors_mu.Lock()
+		p.dialErrors[host]++
+		p.dialErrors_mu.Unlock()
+		return nil, 0, err
 	}
 
 	max := p.poolconfig.MaxSessions
@@ -279,13 +393,32 @@ retry:
 		max = DefaultMaxSessions
 	}
 
+	// If keepalive is enabled, give it a dedicated slot in sessions on top of
+	// max so it never has to contend with real callers for a spot.
+	keepaliveReserved := p.poolconfig.KeepaliveInterval > 0 && p.poolconfig.KeepaliveTimeout > 0
+	capacity := max
+	if keepaliveReserved {
+		capacity++
+	}
+
 	c := &client{
-		Client:   sshclient,
-		sessions: make(chan struct{}, max),
+		Client:            sshclient,
+		sessions:          make(chan struct{}, capacity),
+		evicted:           make(chan struct{}),
+		stop:              make(chan struct{}),
+		keepaliveReserved: keepaliveReserved,
+		lastReleased:      time.Now(),
 	}
 
 	// reserve first session
 	c.sessions <- struct{}{}
+	c.markReserved()
+
+	// claim keepalive's dedicated slot before c is visible to other callers,
+	// so none of them can take it first.
+	if keepaliveReserved {
+		c.sessions <- struct{}{}
+	}
 
 	p.clients_mu.Lock()
 	p.nextclientid++
@@ -293,15 +426,25 @@ retry:
 	p.clients[host] = append(p.clients[host], c)
 	p.clients_mu.Unlock()
 
+	p.startKeepalive(host, c)
+
 	return c, sessionid, nil
 }
 
 func (p *Pool) Close() {
+	if p.reaperRunning {
+		close(p.reaperStop)
+		p.reaperRunning = false
+	}
+
 	p.clients_mu.Lock()
 	defer p.clients_mu.Unlock()
 
 	for host, clients := range p.clients {
 		for _, client := range clients {
+			if atomic.CompareAndSwapInt32(&client.closed, 0, 1) {
+				close(client.stop)
+			}
 			client.Client.Close()
 		}
 		delete(p.clients, host)
@@ -0,0 +1,99 @@
+package sshpool
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHConn is a minimal ssh.Conn that never touches the network, so tests
+// can build a real *ssh.Client to embed in a *client without dialing.
+type fakeSSHConn struct{}
+
+func (fakeSSHConn) User() string          { return "test" }
+func (fakeSSHConn) SessionID() []byte     { return nil }
+func (fakeSSHConn) ClientVersion() []byte { return nil }
+func (fakeSSHConn) ServerVersion() []byte { return nil }
+func (fakeSSHConn) RemoteAddr() net.Addr  { return nil }
+func (fakeSSHConn) LocalAddr() net.Addr   { return nil }
+func (fakeSSHConn) Close() error          { return nil }
+func (fakeSSHConn) Wait() error           { return nil }
+func (fakeSSHConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+func (fakeSSHConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, net.ErrClosed
+}
+
+// newTestClient builds a *client backed by a fake, network-free ssh.Client
+// so get_client/reapClient logic can be exercised without dialing.
+func newTestClient(id, sessions int) *client {
+	chans := make(chan ssh.NewChannel)
+	reqs := make(chan *ssh.Request)
+	close(chans)
+	close(reqs)
+
+	return &client{
+		Client:   ssh.NewClient(fakeSSHConn{}, chans, reqs),
+		sessions: make(chan struct{}, sessions),
+		clientid: id,
+		evicted:  make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+// TestGetClientReservesExactlyOneSlot guards against the noblock loop
+// reserving a session slot on every free client it passes over instead of
+// just the one it returns: with two free clients for a host, get_client must
+// hand back one of them with exactly one slot consumed overall.
+func TestGetClientReservesExactlyOneSlot(t *testing.T) {
+	p := New(&ssh.ClientConfig{}, &PoolConfig{})
+
+	a := newTestClient(1, 1)
+	b := newTestClient(2, 1)
+	p.clients["host"] = []*client{a, b}
+
+	got, _, err := p.get_client(context.Background(), "host")
+	if err != nil {
+		t.Fatalf("get_client: %v", err)
+	}
+
+	var other *client
+	switch got {
+	case a:
+		other = b
+	case b:
+		other = a
+	default:
+		t.Fatalf("get_client returned an unknown client")
+	}
+
+	if len(got.sessions) != 1 {
+		t.Errorf("returned client: want 1 reserved slot, got %d", len(got.sessions))
+	}
+	if len(other.sessions) != 0 {
+		t.Errorf("other client: want 0 reserved slots (leaked), got %d", len(other.sessions))
+	}
+
+	// A second call must be able to claim the other client's free slot,
+	// which would block forever if the first call had leaked a slot on it.
+	done := make(chan struct{})
+	go func() {
+		got2, _, err := p.get_client(context.Background(), "host")
+		if err != nil {
+			t.Errorf("second get_client: %v", err)
+		} else if got2 != other {
+			t.Errorf("second get_client: want %v, got %v", other, got2)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second get_client call blocked: a slot was leaked")
+	}
+}
@@ -0,0 +1,255 @@
+package sshpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultDialRetryInitialDelay is used when DialRetryConfig.InitialDelay is 0.
+	DefaultDialRetryInitialDelay = 200 * time.Millisecond
+
+	// DefaultDialRetryMaxDelay is used when DialRetryConfig.MaxDelay is 0.
+	DefaultDialRetryMaxDelay = 10 * time.Second
+)
+
+// DialRetryConfig configures the exponential-backoff retry applied to
+// dialing a host and to opening a session (or sftp client) on an existing
+// connection. Only transient network errors are retried; authentication
+// failures are returned immediately.
+type DialRetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first. If
+	// left at 0, no retrying happens (this is the same as leaving
+	// PoolConfig.DialRetry nil).
+	MaxAttempts int
+
+	// InitialDelay is the delay before the first retry. If 0,
+	// DefaultDialRetryInitialDelay is used.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the backoff delay. If 0, DefaultDialRetryMaxDelay is used.
+	MaxDelay time.Duration
+
+	// Jitter is a fraction (0.0-1.0) of the computed delay to randomize by,
+	// so a burst of callers retrying at once don't all hammer the host in
+	// lockstep.
+	Jitter float64
+
+	// CoolDown is how long a host is marked unhealthy after a dial has used
+	// up all its attempts and the last one failed on a transient error. A
+	// non-transient failure (e.g. auth) never marks it. While unhealthy, new Get()/GetSFTP() calls
+	// fail immediately instead of waiting to dial again. If 0, hosts are
+	// never marked unhealthy.
+	CoolDown time.Duration
+}
+
+func (p *Pool) markUnhealthy(host string, coolDown time.Duration) {
+	p.unhealthy_mu.Lock()
+	defer p.unhealthy_mu.Unlock()
+	if p.unhealthy == nil {
+		p.unhealthy = make(map[string]time.Time)
+	}
+	p.unhealthy[host] = time.Now().Add(coolDown)
+}
+
+// checkUnhealthy returns an error if host is currently in its dial cool-down.
+func (p *Pool) checkUnhealthy(host string) error {
+	p.unhealthy_mu.Lock()
+	until, bad := p.unhealthy[host]
+	p.unhealthy_mu.Unlock()
+
+	if bad && time.Now().Before(until) {
+		return fmt.Errorf("sshpool: %s: host is unhealthy (cooling down until %s)", host, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func backoffDelay(retry *DialRetryConfig, attempt int) time.Duration {
+	initial := retry.InitialDelay
+	if initial <= 0 {
+		initial = DefaultDialRetryInitialDelay
+	}
+	max := retry.MaxDelay
+	if max <= 0 {
+		max = DefaultDialRetryMaxDelay
+	}
+
+	delay := initial << uint(attempt-1)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+
+	if retry.Jitter > 0 {
+		spread := float64(delay) * retry.Jitter
+		delay = delay - time.Duration(spread) + time.Duration(rand.Float64()*2*spread)
+	}
+
+	return delay
+}
+
+// dialWithRetry dials and performs the SSH handshake against addr, retrying
+// on transient errors per p.poolconfig.DialRetry. On exhausting the retries
+// it marks host unhealthy for DialRetry.CoolDown, if configured. Only the
+// caller holding the dialing[host] lock in get_client ever reaches this, so
+// there's no concurrent retrying against the same host.
+func (p *Pool) dialWithRetry(ctx context.Context, host, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	retry := p.poolconfig.DialRetry
+
+	attempts := 1
+	if retry != nil && retry.MaxAttempts > 0 {
+		attempts = retry.MaxAttempts
+	}
+
+	var (
+		lastErr   error
+		transient bool
+	)
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var dialer net.Dialer
+		netconn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			var sshconn ssh.Conn
+			var chans <-chan ssh.NewChannel
+			var reqs <-chan *ssh.Request
+			sshconn, chans, reqs, err = ssh.NewClientConn(netconn, addr, config)
+			if err == nil {
+				return ssh.NewClient(sshconn, chans, reqs), nil
+			}
+			netconn.Close()
+		}
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ssh dial %#v: %w", host, ctx.Err())
+		}
+
+		lastErr = err
+		transient = isTransientDialErr(err)
+		if attempt == attempts || !transient {
+			break
+		}
+
+		select {
+		case <-time.After(backoffDelay(retry, attempt)):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("ssh dial %#v: %w", host, ctx.Err())
+		}
+	}
+
+	// Only a host that exhausted its attempts on a transient error looks
+	// "down" -- an immediate non-transient failure (e.g. auth) means the
+	// connection itself works fine, so it shouldn't trip the cool-down and
+	// mislead concurrent/subsequent callers with an unhealthy-host error.
+	if transient && retry != nil && retry.CoolDown > 0 {
+		p.markUnhealthy(host, retry.CoolDown)
+	}
+
+	return nil, fmt.Errorf("ssh dial %#v: %v", host, lastErr)
+}
+
+// newSessionWithRetry opens a session on an already-dialed connection,
+// retrying transient failures the same way dialWithRetry does. Unlike a dial
+// failure, this never marks the host unhealthy: the connection itself is
+// fine, only session negotiation on it failed.
+func (p *Pool) newSessionWithRetry(ctx context.Context, sshclient *ssh.Client) (*ssh.Session, error) {
+	retry := p.poolconfig.DialRetry
+
+	attempts := 1
+	if retry != nil && retry.MaxAttempts > 0 {
+		attempts = retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		s, err := sshclient.NewSession()
+		if err == nil {
+			return s, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt == attempts || !isTransientDialErr(err) {
+			break
+		}
+
+		select {
+		case <-time.After(backoffDelay(retry, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, lastErr
+}
+
+// newSFTPClientWithRetry is the sftp.NewClient counterpart to
+// newSessionWithRetry.
+func (p *Pool) newSFTPClientWithRetry(ctx context.Context, sshclient *ssh.Client) (*sftp.Client, error) {
+	retry := p.poolconfig.DialRetry
+
+	attempts := 1
+	if retry != nil && retry.MaxAttempts > 0 {
+		attempts = retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		s, err := sftp.NewClient(sshclient, p.sftpClientOptions()...)
+		if err == nil {
+			return s, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt == attempts || !isTransientDialErr(err) {
+			break
+		}
+
+		select {
+		case <-time.After(backoffDelay(retry, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, lastErr
+}
+
+// isTransientDialErr reports whether err looks like a transient network
+// condition worth retrying, as opposed to e.g. an authentication failure.
+func isTransientDialErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		msg := opErr.Error()
+		if strings.Contains(msg, "connection refused") || strings.Contains(msg, "timeout") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,191 @@
+package sshpool
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// evictionGracePeriod bounds how long accept() waits for c.evicted to close
+// after a listener error before concluding the error is real. Accept()'s
+// error on a dropped connection typically arrives before the keepalive
+// goroutine notices and evicts the client, so a single non-blocking probe
+// would misclassify a reconnect as a fatal failure.
+const evictionGracePeriod = 2 * time.Second
+
+// ReverseTunnel is a remote -> local port forward: it listens on the SSH
+// server via host and forwards each accepted connection to localTarget.
+// Be sure to call Close() to clean up.
+type ReverseTunnel struct {
+	pool        *Pool
+	host        string
+	remoteBind  string
+	localTarget string
+	ctx         context.Context
+
+	closeCh chan struct{}
+
+	mu       sync.Mutex
+	client   *client
+	listener net.Listener
+	closed   bool
+}
+
+// ReverseTunnel() opens a listener on host's SSH server at remoteBind and
+// forwards each accepted connection to localTarget.
+func (p *Pool) ReverseTunnel(host, remoteBind, localTarget string) (*ReverseTunnel, error) {
+	return p.ReverseTunnelContext(context.Background(), host, remoteBind, localTarget)
+}
+
+// ReverseTunnelContext is like ReverseTunnel, but ctx can cancel the initial
+// wait for a session on host.
+func (p *Pool) ReverseTunnelContext(ctx context.Context, host, remoteBind, localTarget string) (*ReverseTunnel, error) {
+	rt := &ReverseTunnel{
+		pool:        p,
+		host:        host,
+		remoteBind:  remoteBind,
+		localTarget: localTarget,
+		ctx:         ctx,
+		closeCh:     make(chan struct{}),
+	}
+
+	if err := rt.listen(); err != nil {
+		return nil, err
+	}
+
+	go rt.accept()
+
+	return rt, nil
+}
+
+// listen reserves a session slot on host for the lifetime of the remote
+// listener and opens it. It's also used to re-establish the remote listener
+// on a freshly dialed client after the old one is evicted by keepalive.
+func (rt *ReverseTunnel) listen() error {
+	c, _, err := rt.pool.get_client(rt.ctx, rt.host)
+	if err != nil {
+		return err
+	}
+
+	listener, err := c.Listen("tcp", rt.remoteBind)
+	if err != nil {
+		c.release()
+		return err
+	}
+
+	rt.mu.Lock()
+	rt.client = c
+	rt.listener = listener
+	rt.mu.Unlock()
+
+	return nil
+}
+
+func (rt *ReverseTunnel) Close() error {
+	rt.mu.Lock()
+	if rt.closed {
+		rt.mu.Unlock()
+		return nil
+	}
+	rt.closed = true
+	listener := rt.listener
+	c := rt.client
+	rt.mu.Unlock()
+
+	close(rt.closeCh)
+	err := listener.Close()
+	if c != nil {
+		c.release()
+	}
+	return err
+}
+
+func (rt *ReverseTunnel) Addr() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.listener.Addr().String()
+}
+
+func (rt *ReverseTunnel) accept() {
+	for {
+		rt.mu.Lock()
+		listener := rt.listener
+		c := rt.client
+		rt.mu.Unlock()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-rt.closeCh:
+				// graceful shutdown
+				return
+			default:
+			}
+
+			if rt.waitEvicted(c) {
+				// the underlying connection died; re-establish the remote
+				// listener on a freshly dialed client and keep going.
+				if err := rt.listen(); err != nil {
+					log.Println("reverse tunnel relisten:", err)
+					return
+				}
+				continue
+			}
+
+			log.Println("reverse tunnel accept:", err)
+			return
+		}
+
+		go rt.forward(conn)
+	}
+}
+
+// waitEvicted reports whether c is (or soon becomes) evicted by the
+// keepalive subsystem, giving it up to evictionGracePeriod to notice a dead
+// connection before giving up.
+func (rt *ReverseTunnel) waitEvicted(c *client) bool {
+	select {
+	case <-c.evicted:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(evictionGracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-c.evicted:
+		return true
+	case <-rt.closeCh:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+func (rt *ReverseTunnel) forward(remote net.Conn) {
+	defer remote.Close()
+
+	local, err := net.Dial("tcp", rt.localTarget)
+	if err != nil {
+		log.Println("reverse tunnel dial local:", err)
+		return
+	}
+	defer local.Close()
+
+	go func() {
+		defer local.Close()
+		defer remote.Close()
+
+		if _, err := io.Copy(local, remote); err != nil {
+			log.Println("copy remote, local:", err)
+		}
+	}()
+
+	if _, err := io.Copy(remote, local); err != nil {
+		log.Println("copy local, remote:", err)
+	}
+}
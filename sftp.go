@@ -1,6 +1,7 @@
 package sshpool
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -21,7 +22,14 @@ func (s *SFTPSession) String() string {
 }
 
 func (p *Pool) GetSFTP(host string) (*SFTPSession, error) {
-	client, sessionid, err := p.get_client(host)
+	return p.GetSFTPContext(context.Background(), host)
+}
+
+// GetSFTPContext is like GetSFTP, but the wait for a free session slot (or
+// for a new connection to dial) is cancellable via ctx. If ctx is done
+// first, the returned error wraps ctx.Err().
+func (p *Pool) GetSFTPContext(ctx context.Context, host string) (*SFTPSession, error) {
+	client, sessionid, err := p.get_client(ctx, host)
 	if err != nil {
 		return nil, err
 	}
@@ -30,9 +38,9 @@ func (p *Pool) GetSFTP(host string) (*SFTPSession, error) {
 		log.Printf("sshpool %s c%d s%d new sftp session\n", host, client.clientid, sessionid)
 	}
 
-	s, err := sftp.NewClient(client.Client)
+	s, err := p.newSFTPClientWithRetry(ctx, client.Client)
 	if err != nil {
-		_ = <-client.sessions
+		client.release()
 		return nil, err
 	}
 
@@ -57,7 +65,7 @@ func (s *SFTPSession) Put() {
 		} else {
 			time.Sleep(s.pool.poolconfig.SessionCloseDelay)
 		}
-		_ = <-s.client.sessions
+		s.client.release()
 	}()
 	return
 }
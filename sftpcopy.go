@@ -0,0 +1,413 @@
+package sshpool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// DefaultSFTPBufferSize is the copy buffer size used when
+	// SFTPTransferConfig.BufferSize is 0.
+	DefaultSFTPBufferSize = 32 * 1024
+
+	// DefaultSFTPConcurrency is the number of in-flight requests per file
+	// used when SFTPTransferConfig.Concurrency is 0.
+	DefaultSFTPConcurrency = 64
+)
+
+// SFTPSyncPolicy controls whether PutFile/GetFile/PutDir/GetDir re-transfer a
+// file that already appears to exist at the destination.
+type SFTPSyncPolicy int
+
+const (
+	// SFTPOverwrite always transfers, replacing anything already there.
+	SFTPOverwrite SFTPSyncPolicy = iota
+
+	// SFTPSkipUnchanged stats the destination first and skips the transfer
+	// if size and mtime already match. If the sizes match but the mtimes
+	// don't (or the remote mtime is zero), it falls back to comparing a
+	// sha256sum, run remotely on the sftp session's own connection.
+	SFTPSkipUnchanged
+)
+
+// SFTPTransferConfig configures PutFile/GetFile/PutDir/GetDir and the
+// underlying sftp client's pipelining.
+type SFTPTransferConfig struct {
+	// BufferSize is the size of the buffer passed to io.CopyBuffer. If 0,
+	// DefaultSFTPBufferSize is used. The *sftp.File side of each copy
+	// implements io.ReaderFrom/io.WriterTo, which io.CopyBuffer uses instead,
+	// so this buffer does not set the chunk size of PutFile/GetFile transfers.
+	BufferSize int
+
+	// Concurrency is the number of in-flight read/write requests the sftp
+	// client keeps outstanding per file. If 0, DefaultSFTPConcurrency is
+	// used.
+	Concurrency int
+
+	// PacketSize caps the size of each sftp read/write packet (sftp.MaxPacket).
+	// If 0, the pkg/sftp default is used.
+	PacketSize int
+
+	// Policy decides whether an already-present destination file is
+	// re-transferred. Defaults to SFTPOverwrite.
+	Policy SFTPSyncPolicy
+
+	// Progress, if set, is called after each chunk is copied, with the
+	// cumulative bytes written and the total size if known (0 if not).
+	Progress func(path string, written, total int64)
+}
+
+func (p *Pool) sftpTransferConfig() *SFTPTransferConfig {
+	if p.poolconfig.SFTPTransfer != nil {
+		return p.poolconfig.SFTPTransfer
+	}
+	return &SFTPTransferConfig{}
+}
+
+func (p *Pool) sftpClientOptions() []sftp.ClientOption {
+	cfg := p.sftpTransferConfig()
+
+	concurrency := cfg.Concurrency
+	if concurrency == 0 {
+		concurrency = DefaultSFTPConcurrency
+	}
+
+	opts := []sftp.ClientOption{
+		sftp.UseConcurrentWrites(true),
+		sftp.UseConcurrentReads(true),
+		sftp.MaxConcurrentRequestsPerFile(concurrency),
+	}
+	if cfg.PacketSize > 0 {
+		opts = append(opts, sftp.MaxPacket(cfg.PacketSize))
+	}
+	return opts
+}
+
+// progressReader wraps an io.Reader, invoking cb with the cumulative bytes
+// read after each Read.
+type progressReader struct {
+	io.Reader
+	path    string
+	total   int64
+	read    int64
+	cb      func(path string, written, total int64)
+}
+
+func (r *progressReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if n > 0 {
+		r.read += int64(n)
+		r.cb(r.path, r.read, r.total)
+	}
+	return n, err
+}
+
+// PutFile uploads local to remote on host, creating remote with mode.
+func (p *Pool) PutFile(host, local, remote string, mode os.FileMode) error {
+	sess, err := p.GetSFTP(host)
+	if err != nil {
+		return fmt.Errorf("sftp put %#v to host %s: %v", local, host, err)
+	}
+	defer sess.Put()
+
+	if err := putFile(p, sess, local, remote, mode); err != nil {
+		return fmt.Errorf("sftp put %#v to host %s: %v", local, host, err)
+	}
+	return nil
+}
+
+// GetFile downloads remote from host to local.
+func (p *Pool) GetFile(host, remote, local string) error {
+	sess, err := p.GetSFTP(host)
+	if err != nil {
+		return fmt.Errorf("sftp get %#v from host %s: %v", remote, host, err)
+	}
+	defer sess.Put()
+
+	if err := getFile(p, sess, remote, local); err != nil {
+		return fmt.Errorf("sftp get %#v from host %s: %v", remote, host, err)
+	}
+	return nil
+}
+
+// PutDir recursively uploads the contents of local to remote on host,
+// creating intermediate directories as needed.
+func (p *Pool) PutDir(host, local, remote string) error {
+	sess, err := p.GetSFTP(host)
+	if err != nil {
+		return fmt.Errorf("sftp put dir %#v to host %s: %v", local, host, err)
+	}
+	defer sess.Put()
+
+	err = filepath.Walk(local, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(local, path)
+		if err != nil {
+			return err
+		}
+		remotePath := filepath.ToSlash(filepath.Join(remote, rel))
+
+		if info.IsDir() {
+			return sess.MkdirAll(remotePath)
+		}
+		return putFile(p, sess, path, remotePath, info.Mode())
+	})
+	if err != nil {
+		return fmt.Errorf("sftp put dir %#v to host %s: %v", local, host, err)
+	}
+	return nil
+}
+
+// GetDir recursively downloads the contents of remote on host to local,
+// creating intermediate directories as needed.
+func (p *Pool) GetDir(host, remote, local string) error {
+	sess, err := p.GetSFTP(host)
+	if err != nil {
+		return fmt.Errorf("sftp get dir %#v from host %s: %v", remote, host, err)
+	}
+	defer sess.Put()
+
+	walker := sess.Walk(remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("sftp get dir %#v from host %s: %v", remote, host, err)
+		}
+
+		rel, err := filepath.Rel(remote, walker.Path())
+		if err != nil {
+			return fmt.Errorf("sftp get dir %#v from host %s: %v", remote, host, err)
+		}
+		localPath := filepath.Join(local, rel)
+
+		if walker.Stat().IsDir() {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return fmt.Errorf("sftp get dir %#v from host %s: %v", remote, host, err)
+			}
+			continue
+		}
+
+		if err := getFile(p, sess, walker.Path(), localPath); err != nil {
+			return fmt.Errorf("sftp get dir %#v from host %s: %v", remote, host, err)
+		}
+	}
+	return nil
+}
+
+func putFile(p *Pool, sess *SFTPSession, local, remote string, mode os.FileMode) error {
+	cfg := p.sftpTransferConfig()
+
+	localInfo, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Policy == SFTPSkipUnchanged {
+		unchanged, err := p.remoteMatchesLocal(sess, remote, local, localInfo)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+	}
+
+	if err := sess.MkdirAll(filepath.ToSlash(filepath.Dir(remote))); err != nil {
+		return err
+	}
+
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := sess.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var reader io.Reader = in
+	if cfg.Progress != nil {
+		reader = &progressReader{Reader: in, path: local, total: localInfo.Size(), cb: cfg.Progress}
+	}
+
+	buf := make([]byte, bufferSize(cfg))
+	if _, err := io.CopyBuffer(out, reader, buf); err != nil {
+		return err
+	}
+
+	return sess.Chmod(remote, mode)
+}
+
+func getFile(p *Pool, sess *SFTPSession, remote, local string) error {
+	cfg := p.sftpTransferConfig()
+
+	remoteInfo, err := sess.Stat(remote)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Policy == SFTPSkipUnchanged {
+		unchanged, err := p.localMatchesRemote(sess, remote, local, remoteInfo)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	in, err := sess.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, remoteInfo.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var writer io.Writer = out
+	if cfg.Progress != nil {
+		writer = &progressWriter{Writer: out, path: remote, total: remoteInfo.Size(), cb: cfg.Progress}
+	}
+
+	buf := make([]byte, bufferSize(cfg))
+	_, err = io.CopyBuffer(writer, in, buf)
+	return err
+}
+
+// progressWriter is the write-side counterpart to progressReader, used for
+// downloads.
+type progressWriter struct {
+	io.Writer
+	path    string
+	total   int64
+	written int64
+	cb      func(path string, written, total int64)
+}
+
+func (w *progressWriter) Write(buf []byte) (int, error) {
+	n, err := w.Writer.Write(buf)
+	if n > 0 {
+		w.written += int64(n)
+		w.cb(w.path, w.written, w.total)
+	}
+	return n, err
+}
+
+func bufferSize(cfg *SFTPTransferConfig) int {
+	if cfg.BufferSize > 0 {
+		return cfg.BufferSize
+	}
+	return DefaultSFTPBufferSize
+}
+
+// remoteMatchesLocal reports whether the file already at remote looks like
+// it's the same as localInfo, first by size+mtime and falling back to a
+// sha256sum comparison if the sizes match but the mtimes don't (or the
+// remote mtime is zero).
+func (p *Pool) remoteMatchesLocal(sess *SFTPSession, remote, local string, localInfo os.FileInfo) (bool, error) {
+	remoteInfo, err := sess.Stat(remote)
+	if err != nil {
+		return false, nil // doesn't exist (or unreadable): not unchanged
+	}
+
+	if remoteInfo.Size() != localInfo.Size() {
+		return false, nil
+	}
+	if !remoteInfo.ModTime().IsZero() && remoteInfo.ModTime().Equal(localInfo.ModTime()) {
+		return true, nil
+	}
+
+	localSum, err := sha256File(local)
+	if err != nil {
+		return false, nil
+	}
+	remoteSum, err := remoteSHA256(sess, remote)
+	if err != nil {
+		return false, nil
+	}
+	return localSum == remoteSum, nil
+}
+
+// localMatchesRemote is the download-side counterpart of remoteMatchesLocal:
+// size+mtime first, falling back to sha256sum the same way.
+func (p *Pool) localMatchesRemote(sess *SFTPSession, remote, local string, remoteInfo os.FileInfo) (bool, error) {
+	localInfo, err := os.Stat(local)
+	if err != nil {
+		return false, nil
+	}
+
+	if localInfo.Size() != remoteInfo.Size() {
+		return false, nil
+	}
+	if !remoteInfo.ModTime().IsZero() && remoteInfo.ModTime().Equal(localInfo.ModTime()) {
+		return true, nil
+	}
+
+	localSum, err := sha256File(local)
+	if err != nil {
+		return false, nil
+	}
+	remoteSum, err := remoteSHA256(sess, remote)
+	if err != nil {
+		return false, nil
+	}
+	return localSum == remoteSum, nil
+}
+
+// remoteSHA256 runs sha256sum on remote over sess's own ssh connection
+// rather than going through the pool: PutFile/GetFile already hold sess's
+// session slot, and with a size-1 pool (MaxConnections/MaxSessions == 1) a
+// second Get()/ExecOutput() against the same host would block on that same
+// slot forever.
+func remoteSHA256(sess *SFTPSession, remote string) (string, error) {
+	s, err := sess.pool.newSessionWithRetry(context.Background(), sess.client.Client)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	out, err := s.CombinedOutput(fmt.Sprintf("sha256sum %q", remote))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("sha256sum %#v: unexpected output %#v", remote, string(out))
+	}
+	return fields[0], nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,6 +1,7 @@
-package pool
+package sshpool
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -13,11 +14,19 @@ type Tunnel struct {
 	host     string
 	remote   string
 	pool     *Pool
+	ctx      context.Context
 }
 
 // Tunnel() creates an SSH tunnel to host. A local TCP socket will listen on local. Any connections
 // will be proxied to remote via host. Be sure to call Close() to clean up.
 func (p *Pool) Tunnel(host string, local, remote string) (*Tunnel, error) {
+	return p.TunnelContext(context.Background(), host, local, remote)
+}
+
+// TunnelContext is like Tunnel, but ctx is threaded through to each
+// forwarded connection's wait for a session on host, so a cancelled ctx
+// stops new connections from being forwarded (existing ones are unaffected).
+func (p *Pool) TunnelContext(ctx context.Context, host string, local, remote string) (*Tunnel, error) {
 
 	listener, err := net.Listen("tcp", local)
 	if err != nil {
@@ -29,6 +38,7 @@ func (p *Pool) Tunnel(host string, local, remote string) (*Tunnel, error) {
 		host:     host,
 		remote:   remote,
 		pool:     p,
+		ctx:      ctx,
 	}
 
 	go tunnel.accept()
@@ -63,14 +73,14 @@ func (tunnel *Tunnel) accept() {
 func (tunnel *Tunnel) forward(local net.Conn) {
 	defer local.Close()
 
-	client, err := tunnel.pool.get_client(tunnel.host)
+	c, _, err := tunnel.pool.get_client(tunnel.ctx, tunnel.host)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	defer client.Close()
+	defer c.release()
 
-	remote, err := client.Dial("tcp", tunnel.remote)
+	remote, err := c.Dial("tcp", tunnel.remote)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -78,7 +88,6 @@ func (tunnel *Tunnel) forward(local net.Conn) {
 	defer remote.Close()
 
 	go func() {
-		defer client.Close() // hopefully it's ok if we double-close
 		defer remote.Close()
 
 		_, err := io.Copy(remote, local)